@@ -0,0 +1,103 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumerOptionsValidate(t *testing.T) {
+	base := func() *consumerOptions {
+		o := newConsumerOptions()
+		o.brokers = []string{"127.0.0.1:9092"}
+		o.topic = "test-topic"
+		return o
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		require.NoError(t, base().validate())
+	})
+
+	t.Run("missing brokers", func(t *testing.T) {
+		o := base()
+		o.brokers = nil
+		require.Error(t, o.validate())
+	})
+
+	t.Run("missing topic", func(t *testing.T) {
+		o := base()
+		o.topic = ""
+		require.Error(t, o.validate())
+	})
+
+	t.Run("invalid offset-reset", func(t *testing.T) {
+		o := base()
+		o.offsetReset = "latest"
+		require.Error(t, o.validate())
+	})
+
+	t.Run("from-ts after to-ts", func(t *testing.T) {
+		o := base()
+		o.fromTs, o.toTs = 10, 5
+		require.Error(t, o.validate())
+	})
+
+	t.Run("to-ts zero means unbounded regardless of from-ts", func(t *testing.T) {
+		o := base()
+		o.fromTs, o.toTs = 10, 0
+		require.NoError(t, o.validate())
+	})
+}
+
+func TestKafkaConsumerShouldPrint(t *testing.T) {
+	newConsumer := func(mutate func(*consumerOptions)) *kafkaConsumer {
+		o := newConsumerOptions()
+		if mutate != nil {
+			mutate(o)
+		}
+		return &kafkaConsumer{opts: o}
+	}
+
+	t.Run("no filters", func(t *testing.T) {
+		c := newConsumer(nil)
+		require.True(t, c.shouldPrint("test", "t1", 1))
+	})
+
+	t.Run("schema mismatch", func(t *testing.T) {
+		c := newConsumer(func(o *consumerOptions) { o.schema = "test" })
+		require.False(t, c.shouldPrint("other", "t1", 1))
+		require.True(t, c.shouldPrint("test", "t1", 1))
+	})
+
+	t.Run("table mismatch", func(t *testing.T) {
+		c := newConsumer(func(o *consumerOptions) { o.table = "t1" })
+		require.False(t, c.shouldPrint("test", "other", 1))
+		require.True(t, c.shouldPrint("test", "t1", 1))
+	})
+
+	t.Run("commit-ts window", func(t *testing.T) {
+		c := newConsumer(func(o *consumerOptions) { o.fromTs, o.toTs = 10, 20 })
+		require.False(t, c.shouldPrint("test", "t1", 9))
+		require.True(t, c.shouldPrint("test", "t1", 10))
+		require.True(t, c.shouldPrint("test", "t1", 20))
+		require.False(t, c.shouldPrint("test", "t1", 21))
+	})
+
+	t.Run("unbounded to-ts", func(t *testing.T) {
+		c := newConsumer(func(o *consumerOptions) { o.fromTs = 10 })
+		require.True(t, c.shouldPrint("test", "t1", 1<<62))
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"time"
+
+	"github.com/pingcap/tiflow/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultCompressionMinSize is the default value of Config.CompressionMinSize.
+// Values shorter than this are not worth the CPU cost of compressing.
+const defaultCompressionMinSize = 1024 // 1 KiB
+
+// defaultChunkAssemblyTimeout is the default value of Config.ChunkAssemblyTimeout.
+const defaultChunkAssemblyTimeout = 5 * time.Minute
+
+// defaultChunkAssemblyMaxPending is the default value of Config.ChunkAssemblyMaxPending.
+const defaultChunkAssemblyMaxPending = 1024
+
+// Config use to create a new event encoder with the given configuration.
+type Config struct {
+	Protocol config.Protocol
+
+	// MaxMessageBytes is the maximum size of the batch.
+	MaxMessageBytes int
+	// MaxBatchSize is the maximum number of messages in a batch.
+	MaxBatchSize int
+
+	// DeleteOnlyHandleKeyColumns is true, for the delete event, only output the handle key columns.
+	DeleteOnlyHandleKeyColumns bool
+
+	EnableTiDBExtension bool
+	EnableRowChecksum   bool
+
+	LargeMessageHandle *config.LargeMessageHandleConfig
+
+	// CompressionMinSize is the minimum serialized value length, in bytes, for which the
+	// encoder will bother invoking LargeMessageHandleCompression. Messages shorter than
+	// this threshold are always written uncompressed, regardless of the configured
+	// compression codec, since compressing a tiny payload wastes CPU and the codec framing
+	// overhead can make the result larger than the original. Whether a given message was
+	// compressed is recorded in the flag byte of its value frame, see valueFlagCompressed
+	// in pkg/sink/codec/open.
+	CompressionMinSize int
+
+	// MaxDecodeErrors bounds how many undecodable message envelopes
+	// `BatchDecoder` tolerates before it gives up and returns an error. A
+	// value of -1 means unlimited (always skip and keep going), 0 (the
+	// default) preserves the historical strict behavior of failing on the
+	// very first bad envelope.
+	MaxDecodeErrors int
+
+	// DecodeErrorSink, when set, receives every envelope `BatchDecoder`
+	// could not decode, along with the offset it was read at and the error
+	// that made it undecodable, so operators can inspect poison messages
+	// without taking the consumer down. It is never called for the
+	// message that finally exceeds MaxDecodeErrors, since that one is
+	// surfaced as a hard error instead.
+	DecodeErrorSink func(key, value []byte, offset int64, err error)
+
+	// ChunkAssemblyTimeout bounds how long `BatchDecoder` keeps a partially
+	// received chunked row's fragments around, under
+	// `LargeMessageHandleOptionChunked`, before giving up on it as orphaned
+	// and dropping it.
+	ChunkAssemblyTimeout time.Duration
+
+	// ChunkAssemblyMaxPending bounds how many distinct in-flight chunked
+	// rows `BatchDecoder` buffers fragments for at once, evicting the least
+	// recently touched one once the limit is reached, so a burst of
+	// abandoned assemblies cannot grow unbounded memory.
+	ChunkAssemblyMaxPending int
+
+	// MetricsRegisterer, when set, opts an encoder built from this Config
+	// into Prometheus metrics (encode duration/bytes, batch row count,
+	// compression ratio, per-result message counts). Left nil, encoding
+	// skips all metric recording, so callers that don't want the overhead
+	// or don't run a Prometheus registry need not set it.
+	MetricsRegisterer prometheus.Registerer
+}
+
+// NewConfig return a Config for a given protocol.
+func NewConfig(protocol config.Protocol) *Config {
+	return &Config{
+		Protocol: protocol,
+
+		MaxMessageBytes: config.DefaultMaxMessageBytes,
+		MaxBatchSize:    config.DefaultMaxBatchSize,
+
+		LargeMessageHandle: config.NewDefaultLargeMessageHandleConfig(),
+
+		CompressionMinSize: defaultCompressionMinSize,
+
+		ChunkAssemblyTimeout:    defaultChunkAssemblyTimeout,
+		ChunkAssemblyMaxPending: defaultChunkAssemblyMaxPending,
+	}
+}
+
+// WithMaxMessageBytes set the `maxMessageBytes`
+func (c *Config) WithMaxMessageBytes(bytes int) *Config {
+	c.MaxMessageBytes = bytes
+	return c
+}
+
+// WithCompressionMinSize set the `CompressionMinSize`
+func (c *Config) WithCompressionMinSize(size int) *Config {
+	c.CompressionMinSize = size
+	return c
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+// Message represents an message to the sink. Callers of an encoder get zero
+// or more Messages per call to Build, and are expected to deliver each to
+// the downstream (e.g. a Kafka producer) and invoke its Callback once
+// delivery is acknowledged.
+type Message struct {
+	Key      []byte
+	Value    []byte
+	Ts       uint64
+	Schema   *string
+	Table    *string
+	Type     int
+	Protocol int
+
+	Callback func()
+}
+
+// Length returns the expected size of the Kafka message on the wire.
+func (m *Message) Length() int {
+	return len(m.Key) + len(m.Value)
+}
+
+// NewMsg creates a new message from the given key/value byte slices.
+func NewMsg(key, value []byte) *Message {
+	return &Message{
+		Key:   key,
+		Value: value,
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// decodeErrorsCounter counts undecodable message envelopes the
+// `BatchDecoder` has skipped or failed on, so operators can alert on a
+// partition accumulating poison messages. Every failure is counted under the
+// single reason label "envelope".
+var decodeErrorsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ticdc",
+		Subsystem: "sink",
+		Name:      "open_protocol_decode_errors_total",
+		Help:      "Total number of message envelopes the open protocol BatchDecoder failed to decode.",
+	}, []string{"reason"})
+
+// chunkAssemblyMetrics counts chunk-reassembly outcomes other than a clean
+// completion, labelled by reason, so operators can alert on a producer whose
+// chunked rows are consistently failing checksum or timing out.
+var chunkAssemblyMetrics = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ticdc",
+		Subsystem: "sink",
+		Name:      "open_protocol_chunk_assembly_total",
+		Help:      "Total number of chunked-row reassembly outcomes, by reason.",
+	}, []string{"reason"})
+
+// encodeDurationHistogram observes how long a single AppendRowChangedEvent /
+// EncodeDDLEvent / EncodeCheckpointEvent call takes to serialize (and, where
+// applicable, compress) one event.
+var encodeDurationHistogram = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "ticdc",
+		Subsystem: "sink",
+		Name:      "open_protocol_encode_duration_seconds",
+		Help:      "Bucketed histogram of open protocol per-event encode duration in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+
+// encodeBytesHistogram observes the serialized (pre-compression) size of each
+// encoded event's value, in bytes.
+var encodeBytesHistogram = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "ticdc",
+		Subsystem: "sink",
+		Name:      "open_protocol_encode_bytes",
+		Help:      "Bucketed histogram of open protocol per-event encoded value size in bytes.",
+		Buckets:   prometheus.ExponentialBuckets(64, 2, 16),
+	})
+
+// batchRowCountHistogram observes how many row events end up in each
+// `common.Message` produced by Build.
+var batchRowCountHistogram = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "ticdc",
+		Subsystem: "sink",
+		Name:      "open_protocol_batch_row_count",
+		Help:      "Bucketed histogram of the number of row events batched into a single Kafka message.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+// compressionRatioHistogram observes compressed-size / original-size for
+// every message that was actually compressed (messages left uncompressed
+// under CompressionMinSize are not sampled here).
+var compressionRatioHistogram = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "ticdc",
+		Subsystem: "sink",
+		Name:      "open_protocol_compression_ratio",
+		Help:      "Bucketed histogram of compressed-size/original-size for compressed open protocol messages.",
+		Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+	})
+
+// messagesTotalCounter counts encoder outcomes by result: "ok" for every
+// batched row message flushed for Build and every DDL/checkpoint message,
+// "claim_check" for every claim-check location message, "handle_key_only"
+// for every row reduced to its handle-key columns (its batch message is also
+// counted under "ok"), and "too_large" for every row rejected for exceeding
+// MaxMessageBytes. Chunked fragment messages are not counted.
+var messagesTotalCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ticdc",
+		Subsystem: "sink",
+		Name:      "open_protocol_messages_total",
+		Help:      "Total number of Kafka messages produced by the open protocol BatchEncoder, by result.",
+	}, []string{"result"})
+
+// InitMetrics registers every open protocol codec metric with registerer.
+// It is safe to call more than once with the same registerer: an
+// AlreadyRegisteredError from a prior call is ignored.
+func InitMetrics(registerer prometheus.Registerer) {
+	collectors := []prometheus.Collector{
+		decodeErrorsCounter,
+		chunkAssemblyMetrics,
+		encodeDurationHistogram,
+		encodeBytesHistogram,
+		batchRowCountHistogram,
+		compressionRatioHistogram,
+		messagesTotalCounter,
+	}
+	for _, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if !errors.As(err, &are) {
+				panic(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/tiflow/cdc/entry"
+	"github.com/pingcap/tiflow/pkg/compression"
+	"github.com/pingcap/tiflow/pkg/config"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+	"github.com/stretchr/testify/require"
+)
+
+// newBenchRowChangedEvent creates the table test.bench<columnCount> with
+// columnCount varchar(16) columns plus its int primary key and returns the
+// schema helper holding it; the caller builds the insert event against it,
+// so benchmarks can compare encode cost across realistic table widths.
+func newBenchRowChangedEvent(b *testing.B, columnCount int) *entry.SchemaTestHelper {
+	b.Helper()
+	helper := entry.NewSchemaTestHelper(b)
+
+	var cols strings.Builder
+	var values strings.Builder
+	for i := 0; i < columnCount; i++ {
+		fmt.Fprintf(&cols, ", c%d varchar(16)", i)
+		fmt.Fprintf(&values, `, "v%d"`, i)
+	}
+	ddl := fmt.Sprintf("create table test.bench%d(id int primary key%s)", columnCount, cols.String())
+	helper.DDL2Event(ddl)
+	return helper
+}
+
+func benchmarkAppendRowChangedEvent(b *testing.B, columnCount int, compress string) {
+	helper := newBenchRowChangedEvent(b, columnCount)
+	defer helper.Close()
+
+	var cols strings.Builder
+	var values strings.Builder
+	for i := 0; i < columnCount; i++ {
+		fmt.Fprintf(&cols, ", c%d", i)
+		fmt.Fprintf(&values, `, "v%d"`, i)
+	}
+	insert := fmt.Sprintf(`insert into test.bench%d(id%s) values (1%s)`, columnCount, cols.String(), values.String())
+	event := helper.DML2Event(insert, "test", fmt.Sprintf("bench%d", columnCount))
+
+	codecConfig := common.NewConfig(config.ProtocolOpen).WithMaxMessageBytes(8 * 1024 * 1024)
+	codecConfig.LargeMessageHandle.LargeMessageHandleCompression = compress
+	codecConfig.CompressionMinSize = 0 // always exercise the compression path when compress != ""
+
+	ctx := context.Background()
+	builder, err := NewBatchEncoderBuilder(ctx, codecConfig)
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encoder := builder.Build()
+		if err := encoder.AppendRowChangedEvent(ctx, "bench", event, nil); err != nil {
+			b.Fatal(err)
+		}
+		encoder.Build()
+	}
+}
+
+func BenchmarkAppendRowChangedEvent(b *testing.B) {
+	for _, columnCount := range []int{10, 50, 200} {
+		for _, compress := range []string{compression.None, compression.Snappy} {
+			name := fmt.Sprintf("columns=%d/compression=%s", columnCount, label(compress))
+			b.Run(name, func(b *testing.B) {
+				benchmarkAppendRowChangedEvent(b, columnCount, compress)
+			})
+		}
+	}
+}
+
+func label(compress string) string {
+	if compress == "" {
+		return "none"
+	}
+	return compress
+}
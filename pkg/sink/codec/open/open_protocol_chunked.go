@@ -0,0 +1,338 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tiflow/cdc/model"
+	cerror "github.com/pingcap/tiflow/pkg/errors"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+)
+
+// appendChunkedRowChangedEvent splits value (the row's unencoded,
+// uncompressed messageRow JSON) into ordered fragments that each fit within
+// MaxMessageBytes, and appends one standalone Message per fragment. Fragments
+// share keyMsg so Kafka routes them all to the same partition; only the last
+// fragment's Message carries callback, so it fires exactly once the whole
+// row has been written.
+func (d *BatchEncoder) appendChunkedRowChangedEvent(
+	keyMsg *messageKey, key, value []byte, callback func(),
+) error {
+	messageID := newChunkMessageID()
+	checksum := crc32.ChecksumIEEE(value)
+
+	chunkedKeyMsg := *keyMsg
+	chunkedKeyMsg.Chunked = true
+	chunkedKey, releaseChunkedKey, err := encodeKey(&chunkedKeyMsg)
+	if err != nil {
+		return err
+	}
+	defer releaseChunkedKey()
+
+	// Every byte of fixed overhead a fragment message carries besides its
+	// slice of value, so budget leaves exactly enough room for the whole
+	// message (key frame + value frame + fragment header) to fit within
+	// MaxMessageBytes.
+	fixedOverhead := len(versionHead) + 8 + len(chunkedKey) + 9 + chunkFragmentHeaderSize(messageID)
+	budget := d.config.MaxMessageBytes - fixedOverhead
+	if budget <= 0 {
+		return errMessageTooLarge(len(key)+len(value), d.config.MaxMessageBytes)
+	}
+
+	total := (len(value) + budget - 1) / budget
+	if total == 0 {
+		total = 1
+	}
+
+	d.flush()
+	for seq := 0; seq < total; seq++ {
+		start := seq * budget
+		end := start + budget
+		if end > len(value) {
+			end = len(value)
+		}
+
+		fragment := chunkFragment{
+			MessageID:      messageID,
+			Seq:            seq,
+			Total:          total,
+			OriginalLength: len(value),
+			Checksum:       checksum,
+			Payload:        value[start:end],
+		}
+		valueFrame := encodeValueFrame(encodeChunkFragment(&fragment), false)
+
+		m := common.NewMsg(append(append([]byte{}, versionHead...), encodeLengthFrame(chunkedKey)...), valueFrame)
+		if seq == total-1 {
+			m.Callback = callback
+		}
+		d.messageBuf = append(d.messageBuf, m)
+	}
+	return nil
+}
+
+// chunkFragmentHeaderSize returns the exact number of bytes
+// encodeChunkFragment's fixed header occupies for a fragment sharing
+// messageID, not counting Payload itself.
+func chunkFragmentHeaderSize(messageID string) int {
+	return 2 + len(messageID) + 4 + 4 + 8 + 4
+}
+
+// encodeChunkFragment serializes f into a small fixed binary header followed
+// by its raw Payload: [2-byte MessageID length][MessageID][4-byte Seq]
+// [4-byte Total][8-byte OriginalLength][4-byte Checksum][Payload]. This is
+// used instead of json.Marshal because Payload is a []byte, which
+// encoding/json base64-encodes, inflating it by roughly a third - exactly
+// the overhead appendChunkedRowChangedEvent exists to avoid.
+func encodeChunkFragment(f *chunkFragment) []byte {
+	idBytes := []byte(f.MessageID)
+	buf := make([]byte, 2+len(idBytes)+4+4+8+4+len(f.Payload))
+	pos := 0
+	binary.BigEndian.PutUint16(buf[pos:], uint16(len(idBytes)))
+	pos += 2
+	pos += copy(buf[pos:], idBytes)
+	binary.BigEndian.PutUint32(buf[pos:], uint32(f.Seq))
+	pos += 4
+	binary.BigEndian.PutUint32(buf[pos:], uint32(f.Total))
+	pos += 4
+	binary.BigEndian.PutUint64(buf[pos:], uint64(f.OriginalLength))
+	pos += 8
+	binary.BigEndian.PutUint32(buf[pos:], f.Checksum)
+	pos += 4
+	copy(buf[pos:], f.Payload)
+	return buf
+}
+
+// decodeChunkFragmentBytes parses the binary layout encodeChunkFragment
+// writes.
+func decodeChunkFragmentBytes(buf []byte) (*chunkFragment, error) {
+	if len(buf) < 2 {
+		return nil, cerror.ErrOpenProtocolCodecInvalidData.GenWithStack("truncated chunk fragment header")
+	}
+	idLen := int(binary.BigEndian.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < idLen+4+4+8+4 {
+		return nil, cerror.ErrOpenProtocolCodecInvalidData.GenWithStack("truncated chunk fragment header")
+	}
+	messageID := string(buf[:idLen])
+	buf = buf[idLen:]
+	seq := int(binary.BigEndian.Uint32(buf))
+	buf = buf[4:]
+	total := int(binary.BigEndian.Uint32(buf))
+	buf = buf[4:]
+	originalLength := int(binary.BigEndian.Uint64(buf))
+	buf = buf[8:]
+	checksum := binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+	return &chunkFragment{
+		MessageID:      messageID,
+		Seq:            seq,
+		Total:          total,
+		OriginalLength: originalLength,
+		Checksum:       checksum,
+		Payload:        buf,
+	}, nil
+}
+
+func newChunkMessageID() string {
+	return strconv.FormatInt(chunkMessageIDSeq.next(), 36)
+}
+
+// chunkMessageIDSeq hands out process-unique chunk message IDs. It is a
+// counter rather than a random value so tests stay deterministic; uniqueness
+// across a single encoder's fragmented rows is all that matters, since
+// BatchDecoder scopes assemblies by (messageID) within one partition.
+var chunkMessageIDSeq = &chunkIDCounter{}
+
+type chunkIDCounter struct {
+	mu  sync.Mutex
+	cur int64
+}
+
+func (c *chunkIDCounter) next() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cur++
+	return c.cur
+}
+
+// chunkAssembly buffers the fragments received so far for one message ID.
+type chunkAssembly struct {
+	total     int
+	checksum  uint32
+	fragments map[int][]byte
+	lastTouch time.Time
+}
+
+// chunkAssembler reassembles chunked rows across possibly out-of-order,
+// possibly duplicated fragment deliveries, bounding memory with an LRU over
+// in-flight message IDs and dropping assemblies that time out.
+type chunkAssembler struct {
+	maxPending int
+	timeout    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*chunkAssembly
+	order   []string // least-recently-touched first
+}
+
+func newChunkAssembler(maxPending int, timeout time.Duration) *chunkAssembler {
+	if maxPending <= 0 {
+		maxPending = defaultChunkAssemblyMaxPendingFallback
+	}
+	if timeout <= 0 {
+		timeout = defaultChunkAssemblyTimeoutFallback
+	}
+	return &chunkAssembler{
+		maxPending: maxPending,
+		timeout:    timeout,
+		entries:    make(map[string]*chunkAssembly),
+	}
+}
+
+const (
+	defaultChunkAssemblyMaxPendingFallback = 1024
+	defaultChunkAssemblyTimeoutFallback    = 5 * time.Minute
+)
+
+// addFragment records fragment, evicting orphaned/timed-out assemblies first.
+// It returns the reassembled row payload once every fragment for its message
+// ID has arrived and its checksum matches, and nil otherwise.
+func (a *chunkAssembler) addFragment(f *chunkFragment) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.evictExpiredLocked()
+
+	entry, ok := a.entries[f.MessageID]
+	if !ok {
+		if len(a.entries) >= a.maxPending {
+			a.evictOldestLocked()
+		}
+		entry = &chunkAssembly{
+			total:     f.Total,
+			checksum:  f.Checksum,
+			fragments: make(map[int][]byte, f.Total),
+		}
+		a.entries[f.MessageID] = entry
+		a.order = append(a.order, f.MessageID)
+	}
+	a.touchLocked(f.MessageID)
+
+	// Idempotent: a duplicate fragment for a seq already seen is simply ignored.
+	if _, seen := entry.fragments[f.Seq]; !seen {
+		entry.fragments[f.Seq] = f.Payload
+	}
+	entry.lastTouch = time.Now()
+
+	if len(entry.fragments) < entry.total {
+		return nil, nil
+	}
+
+	buf := make([]byte, 0, f.OriginalLength)
+	for seq := 0; seq < entry.total; seq++ {
+		part, ok := entry.fragments[seq]
+		if !ok {
+			// Shouldn't happen given the length check above, but guards
+			// against a corrupt Total claiming fewer fragments than Seq values seen.
+			return nil, nil
+		}
+		buf = append(buf, part...)
+	}
+
+	delete(a.entries, f.MessageID)
+	a.removeFromOrderLocked(f.MessageID)
+
+	if crc32.ChecksumIEEE(buf) != entry.checksum {
+		chunkAssemblyMetrics.WithLabelValues("checksum_mismatch").Inc()
+		return nil, cerror.ErrOpenProtocolCodecInvalidData.GenWithStack(
+			"chunked row %s failed checksum verification", f.MessageID)
+	}
+	return buf, nil
+}
+
+func (a *chunkAssembler) touchLocked(id string) {
+	a.removeFromOrderLocked(id)
+	a.order = append(a.order, id)
+}
+
+func (a *chunkAssembler) removeFromOrderLocked(id string) {
+	for i, existing := range a.order {
+		if existing == id {
+			a.order = append(a.order[:i], a.order[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *chunkAssembler) evictOldestLocked() {
+	if len(a.order) == 0 {
+		return
+	}
+	oldest := a.order[0]
+	a.order = a.order[1:]
+	delete(a.entries, oldest)
+	chunkAssemblyMetrics.WithLabelValues("evicted_capacity").Inc()
+}
+
+func (a *chunkAssembler) evictExpiredLocked() {
+	cutoff := time.Now().Add(-a.timeout)
+	for len(a.order) > 0 {
+		id := a.order[0]
+		entry, ok := a.entries[id]
+		if !ok {
+			a.order = a.order[1:]
+			continue
+		}
+		if entry.lastTouch.After(cutoff) {
+			break
+		}
+		a.order = a.order[1:]
+		delete(a.entries, id)
+		chunkAssemblyMetrics.WithLabelValues("orphaned_timeout").Inc()
+	}
+}
+
+// decodeChunkFragment parses a chunk fragment's value payload and, if it
+// completes an assembly, returns the reassembled row change event.
+func (b *BatchDecoder) decodeChunkFragment(key *messageKey, payload []byte) (*model.RowChangedEvent, error) {
+	if b.chunks == nil {
+		b.chunks = newChunkAssembler(b.config.ChunkAssemblyMaxPending, b.config.ChunkAssemblyTimeout)
+	}
+
+	fragment, err := decodeChunkFragmentBytes(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	reassembled, err := b.chunks.addFragment(fragment)
+	if err != nil {
+		return nil, err
+	}
+	if reassembled == nil {
+		return nil, nil
+	}
+
+	var row messageRow
+	if err := json.Unmarshal(reassembled, &row); err != nil {
+		return nil, cerror.WrapError(cerror.ErrOpenProtocolCodecInvalidData, err)
+	}
+	return msgToRowChange(key, &row), nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"context"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/pkg/config"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+	"github.com/pingcap/tiflow/pkg/sink/codec/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestE2EChunkedMessage(t *testing.T) {
+	_, insertEvent, _, _ := utils.NewLargeEvent4Test(t, config.GetDefaultReplicaConfig())
+
+	ctx := context.Background()
+	topic := ""
+
+	codecConfig := common.NewConfig(config.ProtocolOpen).WithMaxMessageBytes(512)
+	codecConfig.LargeMessageHandle.LargeMessageHandleOption = config.LargeMessageHandleOptionChunked
+
+	builder, err := NewBatchEncoderBuilder(ctx, codecConfig)
+	require.NoError(t, err)
+	encoder := builder.Build()
+
+	err = encoder.AppendRowChangedEvent(ctx, topic, insertEvent, func() {})
+	require.NoError(t, err)
+
+	messages := encoder.Build()
+	require.Greater(t, len(messages), 1, "a large row should be split into several fragments")
+	for _, msg := range messages {
+		require.LessOrEqual(t, len(msg.Key)+len(msg.Value), codecConfig.MaxMessageBytes,
+			"every fragment message must itself stay within MaxMessageBytes")
+	}
+
+	decoder, err := NewBatchDecoder(ctx, codecConfig, nil)
+	require.NoError(t, err)
+
+	var decoded *model.RowChangedEvent
+	for _, msg := range messages {
+		err = decoder.AddKeyValue(msg.Key, msg.Value)
+		require.NoError(t, err)
+
+		messageType, hasNext, err := decoder.HasNext()
+		require.NoError(t, err)
+		if !hasNext {
+			continue
+		}
+		require.Equal(t, model.MessageTypeRow, messageType)
+		decoded, err = decoder.NextRowChangedEvent()
+		require.NoError(t, err)
+	}
+
+	require.NotNil(t, decoded, "the row should be reassembled once every fragment arrived")
+	require.Equal(t, insertEvent.CommitTs, decoded.CommitTs)
+}
+
+func TestChunkAssemblerOutOfOrderAndDuplicateFragments(t *testing.T) {
+	assembler := newChunkAssembler(16, time.Minute)
+
+	full := []byte("hello chunked world")
+	checksum := crc32.ChecksumIEEE(full)
+	first := &chunkFragment{MessageID: "m1", Seq: 0, Total: 2, OriginalLength: len(full), Checksum: checksum, Payload: full[:10]}
+	second := &chunkFragment{MessageID: "m1", Seq: 1, Total: 2, OriginalLength: len(full), Checksum: checksum, Payload: full[10:]}
+
+	// The second fragment arrives first, then again as a duplicate, before
+	// the first ever arrives; neither may corrupt or prematurely complete
+	// the assembly.
+	out, err := assembler.addFragment(second)
+	require.NoError(t, err)
+	require.Nil(t, out)
+
+	out, err = assembler.addFragment(second)
+	require.NoError(t, err)
+	require.Nil(t, out)
+
+	// Delivering the remaining first fragment completes the reassembly,
+	// in the original Seq order regardless of arrival order.
+	out, err = assembler.addFragment(first)
+	require.NoError(t, err)
+	require.Equal(t, full, out)
+}
+
+func TestChunkAssemblerDropsOrphanedAssemblyAfterTimeout(t *testing.T) {
+	assembler := newChunkAssembler(16, time.Millisecond)
+
+	full := []byte("orphaned")
+	_, err := assembler.addFragment(&chunkFragment{
+		MessageID: "orphan", Seq: 0, Total: 2,
+		OriginalLength: len(full), Checksum: crc32.ChecksumIEEE(full), Payload: full,
+	})
+	require.NoError(t, err)
+	require.Len(t, assembler.entries, 1)
+
+	time.Sleep(5 * time.Millisecond)
+
+	// Triggers evictExpiredLocked for the stale "orphan" entry before adding a new one.
+	_, err = assembler.addFragment(&chunkFragment{
+		MessageID: "fresh", Seq: 0, Total: 1,
+		OriginalLength: len(full), Checksum: crc32.ChecksumIEEE(full), Payload: full,
+	})
+	require.NoError(t, err)
+
+	assembler.mu.Lock()
+	_, stillThere := assembler.entries["orphan"]
+	assembler.mu.Unlock()
+	require.False(t, stillThere, "the orphaned assembly should have been dropped once its timeout elapsed")
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/pingcap/tiflow/br/pkg/storage"
+	cerror "github.com/pingcap/tiflow/pkg/errors"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+)
+
+// appendClaimCheckRowChangedEvent uploads value (the row's marshaled,
+// uncompressed messageRow JSON) to the configured claim-check storage and
+// appends a small pointer message carrying its location instead. Schema,
+// Table and Ts still travel with the pointer message's own key, so only the
+// value needs to be fetched back by the decoder.
+func (d *BatchEncoder) appendClaimCheckRowChangedEvent(
+	ctx context.Context, keyMsg *messageKey, value []byte, callback func(),
+) error {
+	location, err := d.writeClaimCheckMessage(ctx, value)
+	if err != nil {
+		return err
+	}
+
+	pointerKeyMsg := *keyMsg
+	pointerKeyMsg.ClaimCheckLocation = location
+	pointerKey, releasePointerKey, err := encodeKey(&pointerKeyMsg)
+	if err != nil {
+		return err
+	}
+	defer releasePointerKey()
+
+	// The pointer message carries no row value of its own.
+	pointerValue, compressed, err := d.maybeCompress(nil)
+	if err != nil {
+		return err
+	}
+	valueFrame := encodeValueFrame(pointerValue, compressed)
+
+	d.flush()
+	m := common.NewMsg(append(append([]byte{}, versionHead...), encodeLengthFrame(pointerKey)...), valueFrame)
+	m.Callback = callback
+	d.messageBuf = append(d.messageBuf, m)
+	d.observeMessageResult("claim_check")
+	return nil
+}
+
+// writeClaimCheckMessage uploads value to LargeMessageHandle.ClaimCheckStorageURI
+// and returns the location the decoder must later fetch it from.
+func (d *BatchEncoder) writeClaimCheckMessage(ctx context.Context, value []byte) (string, error) {
+	storageURI := d.config.LargeMessageHandle.ClaimCheckStorageURI
+	if storageURI == "" {
+		return "", cerror.ErrOpenProtocolCodecInvalidData.GenWithStack(
+			"claim-check large message handling requires LargeMessageHandle.ClaimCheckStorageURI to be set")
+	}
+
+	externalStorage, err := openClaimCheckStorage(ctx, storageURI)
+	if err != nil {
+		return "", err
+	}
+
+	fileName := uuid.NewString() + ".json"
+	if err := externalStorage.WriteFile(ctx, fileName, value); err != nil {
+		return "", cerrorWrap(err)
+	}
+	return fileName, nil
+}
+
+// openClaimCheckStorage opens the external storage backend addressed by
+// storageURI (e.g. a "file://" or "s3://" location), shared by both the
+// encoder's upload path and the decoder's fetch path.
+func openClaimCheckStorage(ctx context.Context, storageURI string) (storage.ExternalStorage, error) {
+	backend, err := storage.ParseBackend(storageURI, nil)
+	if err != nil {
+		return nil, cerror.WrapError(cerror.ErrOpenProtocolCodecInvalidData, err)
+	}
+	return storage.New(ctx, backend, nil)
+}
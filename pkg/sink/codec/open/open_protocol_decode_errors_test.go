@@ -0,0 +1,179 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pingcap/tiflow/cdc/entry"
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/pkg/config"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+	"github.com/stretchr/testify/require"
+)
+
+// buildTwoDDLEventBatch returns the key/value byte streams for a batch
+// containing two well-formed DDL messages, so tests can corrupt the
+// boundary between them and check that decoding resumes at the second one.
+// DDL messages are used rather than checkpoint messages because a
+// checkpoint's value is always empty (just the length prefix and flag byte)
+// and so has no JSON content left to corrupt.
+func buildTwoDDLEventBatch(t *testing.T, codecConfig *common.Config) (key, value []byte, ddl1, ddl2 *model.DDLEvent) {
+	t.Helper()
+
+	helper := entry.NewSchemaTestHelper(t)
+	defer helper.Close()
+
+	ddl1 = helper.DDL2Event(`create table test.t1(id int primary key)`)
+	ddl2 = helper.DDL2Event(`create table test.t2(id int primary key)`)
+
+	ctx := context.Background()
+	builder, err := NewBatchEncoderBuilder(ctx, codecConfig)
+	require.NoError(t, err)
+	encoder := builder.Build()
+
+	for _, ddl := range []*model.DDLEvent{ddl1, ddl2} {
+		msg, err := encoder.EncodeDDLEvent(ddl)
+		require.NoError(t, err)
+		// Each message's key starts with its own version head; the batch
+		// carries a single one, prepended below.
+		key = append(key, msg.Key[len(versionHead):]...)
+		value = append(value, msg.Value...)
+	}
+	key = append(versionHead, key...)
+	return key, value, ddl1, ddl2
+}
+
+// valueFrameJSONOffset returns the offset, within value, of the first byte of
+// frame n's JSON payload (frames are 0-indexed), computed from each
+// preceding frame's own length prefix rather than a hardcoded constant.
+func valueFrameJSONOffset(t *testing.T, value []byte, frame int) int {
+	t.Helper()
+
+	offset := 0
+	for i := 0; ; i++ {
+		require.GreaterOrEqual(t, len(value), offset+9, "value frame %d is missing or truncated", i)
+		length := binary.BigEndian.Uint64(value[offset : offset+8])
+		if i == frame {
+			return offset + 8 + 1 // skip the length prefix and the compression flag byte
+		}
+		offset += 8 + int(length)
+	}
+}
+
+func TestBatchDecoderStrictByDefault(t *testing.T) {
+	codecConfig := common.NewConfig(config.ProtocolOpen)
+	key, value, _, _ := buildTwoDDLEventBatch(t, codecConfig)
+
+	// Corrupt the opening brace of the first frame's JSON payload.
+	value[valueFrameJSONOffset(t, value, 0)] = 0x00
+
+	decoder, err := NewBatchDecoder(context.Background(), codecConfig, nil)
+	require.NoError(t, err)
+	require.NoError(t, decoder.AddKeyValue(key, value))
+
+	_, _, err = decoder.HasNext()
+	require.Error(t, err)
+}
+
+func TestBatchDecoderTolerantSkipsMalformedJSON(t *testing.T) {
+	codecConfig := common.NewConfig(config.ProtocolOpen)
+	codecConfig.MaxDecodeErrors = -1
+
+	key, value, _, ddl2 := buildTwoDDLEventBatch(t, codecConfig)
+	// Corrupt the first frame's JSON payload while keeping its length prefix
+	// intact, so the frame boundary can still be located.
+	value[valueFrameJSONOffset(t, value, 0)] = 0x00
+
+	var sunk []byte
+	codecConfig.DecodeErrorSink = func(k, v []byte, offset int64, err error) {
+		sunk = append(sunk, v...)
+	}
+
+	decoder, err := NewBatchDecoder(context.Background(), codecConfig, nil)
+	require.NoError(t, err)
+	require.NoError(t, decoder.AddKeyValue(key, value))
+
+	messageType, hasNext, err := decoder.HasNext()
+	require.NoError(t, err)
+	require.True(t, hasNext, "decoding should recover at the second DDL message")
+	require.Equal(t, model.MessageTypeDDL, messageType)
+
+	decoded, err := decoder.NextDDLEvent()
+	require.NoError(t, err)
+	require.Equal(t, ddl2.CommitTs, decoded.CommitTs)
+	require.Equal(t, ddl2.Query, decoded.Query)
+	require.NotEmpty(t, sunk, "the bad envelope should have been reported to DecodeErrorSink")
+}
+
+func TestBatchDecoderMaxDecodeErrorsBudget(t *testing.T) {
+	codecConfig := common.NewConfig(config.ProtocolOpen)
+	codecConfig.MaxDecodeErrors = 1
+
+	key, value, _, _ := buildTwoDDLEventBatch(t, codecConfig)
+	// Corrupt both frames' JSON payloads.
+	value[valueFrameJSONOffset(t, value, 0)] = 0x00
+	value[valueFrameJSONOffset(t, value, 1)] = 0x00
+
+	decoder, err := NewBatchDecoder(context.Background(), codecConfig, nil)
+	require.NoError(t, err)
+	require.NoError(t, decoder.AddKeyValue(key, value))
+
+	// First error is within budget (MaxDecodeErrors=1), second exceeds it.
+	_, _, err = decoder.HasNext()
+	require.Error(t, err)
+}
+
+func TestBatchDecoderMismatchedKeyValueCounts(t *testing.T) {
+	codecConfig := common.NewConfig(config.ProtocolOpen)
+	key, value, _, _ := buildTwoDDLEventBatch(t, codecConfig)
+
+	// Drop the second value frame entirely, so the batch has two key frames
+	// but only one value frame: once the first pair is consumed, HasNext
+	// must report an error trying to read a value frame that was never
+	// written, rather than silently pairing the second key with whatever
+	// bytes happen to follow.
+	firstValueFrameLen := 8 + int(binary.BigEndian.Uint64(value[:8]))
+	value = value[:firstValueFrameLen]
+
+	decoder, err := NewBatchDecoder(context.Background(), codecConfig, nil)
+	require.NoError(t, err)
+	require.NoError(t, decoder.AddKeyValue(key, value))
+
+	_, hasNext, err := decoder.HasNext()
+	require.NoError(t, err)
+	require.True(t, hasNext, "the first, well-formed pair should still decode")
+
+	_, _, err = decoder.HasNext()
+	require.Error(t, err, "a key frame with no matching value frame must be reported as an error")
+}
+
+func TestBatchDecoderTruncatedLengthPrefixEndsBatchWhenTolerant(t *testing.T) {
+	codecConfig := common.NewConfig(config.ProtocolOpen)
+	codecConfig.MaxDecodeErrors = -1
+
+	key, value, _, _ := buildTwoDDLEventBatch(t, codecConfig)
+	// Truncate the value stream so the first length prefix cannot be read in full.
+	value = value[:4]
+
+	decoder, err := NewBatchDecoder(context.Background(), codecConfig, nil)
+	require.NoError(t, err)
+	require.NoError(t, decoder.AddKeyValue(key, value))
+
+	_, hasNext, err := decoder.HasNext()
+	require.NoError(t, err)
+	require.False(t, hasNext, "an unresolvable frame boundary ends the batch even when tolerant")
+}
@@ -0,0 +1,329 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+
+	timodel "github.com/pingcap/tidb/pkg/parser/model"
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/pkg/compression"
+	cerror "github.com/pingcap/tiflow/pkg/errors"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+)
+
+// BatchDecoder decodes the byte streams produced by `BatchEncoder` back into
+// row/DDL/resolved-ts events, one call to `HasNext` at a time.
+type BatchDecoder struct {
+	config *common.Config
+	db     *sql.DB
+	// ctx is retained for calls that only happen lazily, well after HasNext
+	// was driven to completion, such as fetching a claim-check blob from
+	// external storage.
+	ctx context.Context
+
+	keyBytes   []byte
+	valueBytes []byte
+	// offset is the Kafka offset of the message currently being decoded, as
+	// passed to AddKeyValueWithOffset. It is forwarded to DecodeErrorSink so
+	// operators can locate a poison message.
+	offset int64
+	// decodeErrors counts envelopes skipped or failed since this decoder was
+	// created, checked against config.MaxDecodeErrors.
+	decodeErrors int
+
+	nextKey   *messageKey
+	nextEvent *model.RowChangedEvent
+	nextDDL   *messageDDL
+
+	// chunks reassembles rows split under LargeMessageHandleOptionChunked.
+	// Lazily created on first use since most decoders never see chunks.
+	chunks *chunkAssembler
+}
+
+// NewBatchDecoder creates a new `BatchDecoder`. `db` is only required when
+// `LargeMessageHandleOption` is `handle-key-only`, so that the caller can
+// later fetch the remaining columns for handle-key-only rows.
+func NewBatchDecoder(ctx context.Context, config *common.Config, db *sql.DB) (*BatchDecoder, error) {
+	if config.MetricsRegisterer != nil {
+		InitMetrics(config.MetricsRegisterer)
+	}
+	return &BatchDecoder{config: config, db: db, ctx: ctx}, nil
+}
+
+// AddKeyValue adds the given key/value pair to the decoder, stripping the
+// leading version header from the key byte stream.
+func (b *BatchDecoder) AddKeyValue(key, value []byte) error {
+	return b.AddKeyValueWithOffset(key, value, 0)
+}
+
+// AddKeyValueWithOffset behaves like AddKeyValue, additionally recording the
+// Kafka offset the pair was read at, so it can be reported to
+// config.DecodeErrorSink if any envelope inside the batch turns out to be
+// undecodable.
+func (b *BatchDecoder) AddKeyValueWithOffset(key, value []byte, offset int64) error {
+	if len(key) < len(versionHead) {
+		return cerror.ErrOpenProtocolCodecInvalidData.GenWithStack("key length %d shorter than version head", len(key))
+	}
+	b.keyBytes = key[len(versionHead):]
+	b.valueBytes = value
+	b.offset = offset
+	return nil
+}
+
+// HasNext reads the next key/value frame pair and decodes it, returning the
+// decoded event's type. Call NextRowChangedEvent/NextDDLEvent/NextResolvedEvent
+// immediately afterward to retrieve it.
+//
+// When config.MaxDecodeErrors is non-zero, an undecodable envelope is
+// reported to config.DecodeErrorSink (if set) and skipped rather than
+// aborting the whole batch; HasNext only returns an error once the running
+// count of skipped envelopes exceeds MaxDecodeErrors, or immediately when
+// MaxDecodeErrors is 0 (the default, preserving the historical strict
+// behavior).
+func (b *BatchDecoder) HasNext() (model.MessageType, bool, error) {
+	for {
+		if len(b.keyBytes) == 0 {
+			return 0, false, nil
+		}
+
+		keyFrame, keyRest, err := decodeLengthFrame(b.keyBytes)
+		if err != nil {
+			return b.abortBatch(b.keyBytes, b.valueBytes, err)
+		}
+
+		valuePayload, valueRest, err := b.decodeValueFrame(b.valueBytes)
+		if err != nil {
+			return b.abortBatch(keyFrame, b.valueBytes, err)
+		}
+
+		var key messageKey
+		if err := json.Unmarshal(keyFrame, &key); err != nil {
+			if stop, mt, hasNext, retErr := b.skipEnvelope(keyFrame, valuePayload, err); stop {
+				return mt, hasNext, retErr
+			}
+			b.keyBytes, b.valueBytes = keyRest, valueRest
+			continue
+		}
+		b.nextKey = &key
+		b.keyBytes, b.valueBytes = keyRest, valueRest
+
+		switch key.Type {
+		case model.MessageTypeResolved:
+			return model.MessageTypeResolved, true, nil
+		case model.MessageTypeDDL:
+			var ddl messageDDL
+			if err := json.Unmarshal(valuePayload, &ddl); err != nil {
+				if stop, mt, hasNext, retErr := b.skipEnvelope(keyFrame, valuePayload, err); stop {
+					return mt, hasNext, retErr
+				}
+				continue
+			}
+			b.nextDDL = &ddl
+			return model.MessageTypeDDL, true, nil
+		default:
+			if key.ClaimCheckLocation != "" {
+				event, err := b.decodeClaimCheckRowChangedEvent(&key)
+				if err != nil {
+					if stop, mt, hasNext, retErr := b.skipEnvelope(keyFrame, valuePayload, err); stop {
+						return mt, hasNext, retErr
+					}
+					continue
+				}
+				b.nextEvent = event
+				return model.MessageTypeRow, true, nil
+			}
+
+			if key.Chunked {
+				event, err := b.decodeChunkFragment(&key, valuePayload)
+				if err != nil {
+					if stop, mt, hasNext, retErr := b.skipEnvelope(keyFrame, valuePayload, err); stop {
+						return mt, hasNext, retErr
+					}
+					continue
+				}
+				if event == nil {
+					// Assembly still in progress; move on to the next frame.
+					continue
+				}
+				b.nextEvent = event
+				return model.MessageTypeRow, true, nil
+			}
+
+			var row messageRow
+			if err := json.Unmarshal(valuePayload, &row); err != nil {
+				if stop, mt, hasNext, retErr := b.skipEnvelope(keyFrame, valuePayload, err); stop {
+					return mt, hasNext, retErr
+				}
+				continue
+			}
+			b.nextEvent = msgToRowChange(&key, &row)
+			return model.MessageTypeRow, true, nil
+		}
+	}
+}
+
+// skipEnvelope records a decode error for a single, recoverable envelope
+// (the frame boundary is intact, only its JSON payload is malformed) and
+// reports whether the caller must stop instead of moving on to the next
+// frame.
+func (b *BatchDecoder) skipEnvelope(key, value []byte, cause error) (stop bool, mt model.MessageType, hasNext bool, err error) {
+	if b.recordDecodeError(key, value, cause) {
+		return true, 0, false, cerror.WrapError(cerror.ErrOpenProtocolCodecInvalidData, cause)
+	}
+	return false, 0, false, nil
+}
+
+// abortBatch records a decode error for a corrupt length prefix, which
+// leaves no reliable frame boundary to resynchronize on. The remainder of
+// the batch is discarded either way; the only choice is whether that is
+// reported as a hard error or tolerated silently.
+func (b *BatchDecoder) abortBatch(key, value []byte, cause error) (model.MessageType, bool, error) {
+	fatal := b.recordDecodeError(key, value, cause)
+	b.keyBytes, b.valueBytes = nil, nil
+	if fatal {
+		return 0, false, cerror.WrapError(cerror.ErrOpenProtocolCodecInvalidData, cause)
+	}
+	return 0, false, nil
+}
+
+// recordDecodeError updates the error budget and, while the budget is not
+// exceeded, reports the bad envelope to config.DecodeErrorSink, returning
+// true once the caller should stop tolerating further errors.
+func (b *BatchDecoder) recordDecodeError(key, value []byte, cause error) (exceeded bool) {
+	b.decodeErrors++
+	decodeErrorsCounter.WithLabelValues("envelope").Inc()
+	exceeded = b.config.MaxDecodeErrors == 0 ||
+		(b.config.MaxDecodeErrors > 0 && b.decodeErrors > b.config.MaxDecodeErrors)
+	if !exceeded && b.config.DecodeErrorSink != nil {
+		b.config.DecodeErrorSink(key, value, b.offset, cause)
+	}
+	return exceeded
+}
+
+// NextRowChangedEvent implements the RowEventDecoder interface
+func (b *BatchDecoder) NextRowChangedEvent() (*model.RowChangedEvent, error) {
+	return b.nextEvent, nil
+}
+
+// NextDDLEvent implements the RowEventDecoder interface
+func (b *BatchDecoder) NextDDLEvent() (*model.DDLEvent, error) {
+	tableInfo, _ := buildDecodedTableInfo(b.nextKey.Schema, b.nextKey.Table)
+	return &model.DDLEvent{
+		CommitTs:  b.nextKey.Ts,
+		Query:     b.nextDDL.Query,
+		Type:      timodel.ActionType(b.nextDDL.Type),
+		TableInfo: tableInfo,
+	}, nil
+}
+
+// NextResolvedEvent implements the RowEventDecoder interface
+func (b *BatchDecoder) NextResolvedEvent() (uint64, error) {
+	return b.nextKey.Ts, nil
+}
+
+func decodeLengthFrame(buf []byte) (frame, rest []byte, err error) {
+	if len(buf) < 8 {
+		return nil, nil, cerror.ErrOpenProtocolCodecInvalidData.GenWithStack("truncated length prefix")
+	}
+	length := binary.BigEndian.Uint64(buf[:8])
+	if uint64(len(buf)-8) < length {
+		return nil, nil, cerror.ErrOpenProtocolCodecInvalidData.GenWithStack("truncated frame, want %d bytes", length)
+	}
+	return buf[8 : 8+length], buf[8+length:], nil
+}
+
+// decodeValueFrame reads one [length][flag][payload] frame and, when the
+// frame's flag marks it as compressed, decompresses payload using the codec
+// configured via LargeMessageHandle.LargeMessageHandleCompression before
+// returning it. Frames written without the compressed flag are returned
+// untouched, which keeps small messages (below CompressionMinSize at encode
+// time) cheap to decode.
+func (b *BatchDecoder) decodeValueFrame(buf []byte) (payload, rest []byte, err error) {
+	frame, rest, err := decodeLengthFrame(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(frame) == 0 {
+		return nil, rest, cerror.ErrOpenProtocolCodecInvalidData.GenWithStack("empty value frame")
+	}
+	flag, raw := frame[0], frame[1:]
+	if flag&valueFlagCompressed == 0 {
+		return raw, rest, nil
+	}
+
+	codecName := b.config.LargeMessageHandle.LargeMessageHandleCompression
+	if codecName == "" || codecName == compression.None {
+		return nil, nil, cerror.ErrOpenProtocolCodecInvalidData.GenWithStack(
+			"received a compressed value frame but no LargeMessageHandle.LargeMessageHandleCompression codec is configured")
+	}
+	decoded, err := compression.Decode(codecName, raw)
+	if err != nil {
+		return nil, nil, cerror.WrapError(cerror.ErrOpenProtocolCodecInvalidData, err)
+	}
+	return decoded, rest, nil
+}
+
+// msgToRowChange rebuilds the RowChangedEvent the encoder produced from its
+// decoded key/value pair. The wire format only ever carries column names and
+// flags, not a real TiDB schema, so buildDecodedTableInfo synthesizes just
+// enough of a TableInfo for ForceGetColumnName/ForceGetColumnFlagType to
+// resolve the columns below.
+func msgToRowChange(key *messageKey, value *messageRow) *model.RowChangedEvent {
+	event := &model.RowChangedEvent{
+		CommitTs: key.Ts,
+	}
+
+	tableInfo, ids := buildDecodedTableInfo(key.Schema, key.Table, value.Update, value.PreColumns, value.Delete)
+	event.TableInfo = tableInfo
+
+	if len(value.Delete) != 0 {
+		event.PreColumns = msgToColumnData(value.Delete, ids)
+		return event
+	}
+	event.Columns = msgToColumnData(value.Update, ids)
+	event.PreColumns = msgToColumnData(value.PreColumns, ids)
+	return event
+}
+
+// decodeClaimCheckRowChangedEvent fetches the row a claim-check pointer
+// message refers to from external storage and decodes it exactly like a
+// normal row envelope; only the value was too large to fit on the wire, the
+// key (and thus Schema/Table/Ts) already came from the pointer message.
+func (b *BatchDecoder) decodeClaimCheckRowChangedEvent(key *messageKey) (*model.RowChangedEvent, error) {
+	storageURI := b.config.LargeMessageHandle.ClaimCheckStorageURI
+	if storageURI == "" {
+		return nil, cerror.ErrOpenProtocolCodecInvalidData.GenWithStack(
+			"received a claim-check pointer message but LargeMessageHandle.ClaimCheckStorageURI is not set")
+	}
+
+	externalStorage, err := openClaimCheckStorage(b.ctx, storageURI)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := externalStorage.ReadFile(b.ctx, key.ClaimCheckLocation)
+	if err != nil {
+		return nil, cerror.WrapError(cerror.ErrOpenProtocolCodecInvalidData, err)
+	}
+
+	var row messageRow
+	if err := json.Unmarshal(raw, &row); err != nil {
+		return nil, cerror.WrapError(cerror.ErrOpenProtocolCodecInvalidData, err)
+	}
+	return msgToRowChange(key, &row), nil
+}
@@ -0,0 +1,399 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/pkg/compression"
+	"github.com/pingcap/tiflow/pkg/config"
+	"github.com/pingcap/tiflow/pkg/sink/codec"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+)
+
+// marshalBufPool is reused across AppendRowChangedEvent/EncodeDDLEvent/
+// EncodeCheckpointEvent calls to scratch-encode a key or value's JSON. The
+// returned bytes alias the borrowed buffer directly rather than being copied
+// out, so callers must not release it (by calling the returned release func)
+// until they are done reading them - in practice, once the bytes have been
+// copied into the length-prefixed frame that actually gets retained in the
+// batch (see encodeLengthFrame/encodeValueFrame).
+var marshalBufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// marshalJSON encodes v into a buffer borrowed from marshalBufPool and
+// returns its bytes along with a release func the caller must defer once it
+// is done reading them.
+func marshalJSON(v interface{}) (encoded []byte, release func(), err error) {
+	buf := marshalBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		marshalBufPool.Put(buf)
+		return nil, nil, cerrorWrap(err)
+	}
+	// json.Encoder.Encode appends a trailing newline we don't want on the wire.
+	return bytes.TrimRight(buf.Bytes(), "\n"), func() { marshalBufPool.Put(buf) }, nil
+}
+
+// versionHead is the first 8 bytes of every key byte stream, identifying the
+// open protocol version in use. Kept unchanged from the original format so
+// that older consumers still recognize the stream as open protocol.
+var versionHead = []byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+// valueFlagCompressed marks a single value frame, within an otherwise
+// uncompressed batch, as carrying a compressed payload. encodeValueFrame
+// writes a flag byte ahead of every payload, and BatchDecoder decompresses a
+// frame only when this bit is set in it. A value stream whose frames carry no
+// flag byte is not understood by BatchDecoder.
+const valueFlagCompressed byte = 0x1
+
+// BatchEncoder encodes the events into the open-protocol format.
+type BatchEncoder struct {
+	config *common.Config
+
+	messageBuf   []*common.Message
+	callbackBuf  []func()
+	curBatchSize int
+	curRowCount  int
+}
+
+// EncodeCheckpointEvent implements the RowEventEncoder interface
+func (d *BatchEncoder) EncodeCheckpointEvent(ts uint64) (*common.Message, error) {
+	defer d.observeEncodeDuration(time.Now())
+
+	keyMsg := &messageKey{
+		Ts:   ts,
+		Type: model.MessageTypeResolved,
+	}
+	key, releaseKey, err := encodeKey(keyMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseKey()
+
+	value, compressed, err := d.maybeCompress(nil)
+	if err != nil {
+		return nil, err
+	}
+	valueFrame := encodeValueFrame(value, compressed)
+
+	m := newResolvedMessage(key, valueFrame, ts)
+	d.observeMessageResult("ok")
+	return m, nil
+}
+
+// EncodeDDLEvent implements the RowEventEncoder interface
+func (d *BatchEncoder) EncodeDDLEvent(e *model.DDLEvent) (*common.Message, error) {
+	defer d.observeEncodeDuration(time.Now())
+
+	keyMsg := &messageKey{
+		Ts:     e.CommitTs,
+		Schema: e.TableInfo.TableName.Schema,
+		Table:  e.TableInfo.TableName.Table,
+		Type:   model.MessageTypeDDL,
+	}
+	key, releaseKey, err := encodeKey(keyMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseKey()
+
+	valueMsg := &messageDDL{
+		Query: e.Query,
+		Type:  byte(e.Type),
+	}
+	value, releaseValue, err := marshalJSON(valueMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseValue()
+
+	compressedValue, compressed, err := d.maybeCompress(value)
+	if err != nil {
+		return nil, err
+	}
+	valueFrame := encodeValueFrame(compressedValue, compressed)
+	d.observeEncodeBytes(len(value), compressed, len(compressedValue))
+
+	m := newDDLMessage(key, valueFrame, e.CommitTs)
+	d.observeMessageResult("ok")
+	return m, nil
+}
+
+// AppendRowChangedEvent implements the RowEventEncoder interface
+func (d *BatchEncoder) AppendRowChangedEvent(
+	ctx context.Context,
+	topic string,
+	e *model.RowChangedEvent,
+	callback func(),
+) error {
+	defer d.observeEncodeDuration(time.Now())
+
+	keyMsg, valueMsg := rowChangeToMsg(e)
+	key, releaseKey, err := encodeKey(keyMsg)
+	if err != nil {
+		return err
+	}
+	defer releaseKey()
+
+	value, releaseValue, err := marshalJSON(valueMsg)
+	if err != nil {
+		return err
+	}
+	defer releaseValue()
+
+	compressedValue, compressed, err := d.maybeCompress(value)
+	if err != nil {
+		return err
+	}
+	valueFrame := encodeValueFrame(compressedValue, compressed)
+	d.observeEncodeBytes(len(value), compressed, len(compressedValue))
+
+	length := len(key) + len(versionHead) + len(valueFrame) + 16
+	if length > d.config.MaxMessageBytes {
+		switch d.config.LargeMessageHandle.LargeMessageHandleOption {
+		case config.LargeMessageHandleOptionChunked:
+			return d.appendChunkedRowChangedEvent(keyMsg, key, value, callback)
+		case config.LargeMessageHandleOptionClaimCheck:
+			return d.appendClaimCheckRowChangedEvent(ctx, keyMsg, value, callback)
+		case config.LargeMessageHandleOptionHandleKeyOnly:
+			return d.appendHandleKeyOnlyRowChangedEvent(keyMsg, e, callback)
+		}
+		d.observeMessageResult("too_large")
+		return errMessageTooLarge(length, d.config.MaxMessageBytes)
+	}
+
+	if d.curBatchSize+length > d.config.MaxMessageBytes ||
+		d.curRowCount >= d.config.MaxBatchSize {
+		d.flush()
+	}
+
+	d.appendToBuf(key, valueFrame, callback)
+	d.curBatchSize += length
+	d.curRowCount++
+	return nil
+}
+
+// appendHandleKeyOnlyRowChangedEvent re-encodes e keeping only its handle-key
+// columns, for LargeMessageHandleOptionHandleKeyOnly. The reduced row still
+// goes through the normal batching path below: dropping the non-handle-key
+// columns is usually enough on its own to bring the message back under
+// MaxMessageBytes.
+func (d *BatchEncoder) appendHandleKeyOnlyRowChangedEvent(
+	keyMsg *messageKey, e *model.RowChangedEvent, callback func(),
+) error {
+	reducedKeyMsg := *keyMsg
+	reducedKeyMsg.OnlyHandleKey = true
+	key, releaseKey, err := encodeKey(&reducedKeyMsg)
+	if err != nil {
+		return err
+	}
+	defer releaseKey()
+
+	valueMsg := &messageRow{}
+	switch {
+	case e.IsDelete():
+		valueMsg.Delete = handleKeyColumnsToMap(e.PreColumns, e.TableInfo)
+	case e.IsUpdate():
+		valueMsg.Update = handleKeyColumnsToMap(e.Columns, e.TableInfo)
+		valueMsg.PreColumns = handleKeyColumnsToMap(e.PreColumns, e.TableInfo)
+	default:
+		valueMsg.Update = handleKeyColumnsToMap(e.Columns, e.TableInfo)
+	}
+
+	value, releaseValue, err := marshalJSON(valueMsg)
+	if err != nil {
+		return err
+	}
+	defer releaseValue()
+
+	compressedValue, compressed, err := d.maybeCompress(value)
+	if err != nil {
+		return err
+	}
+	valueFrame := encodeValueFrame(compressedValue, compressed)
+	d.observeEncodeBytes(len(value), compressed, len(compressedValue))
+
+	length := len(key) + len(versionHead) + len(valueFrame) + 16
+	if length > d.config.MaxMessageBytes {
+		d.observeMessageResult("too_large")
+		return errMessageTooLarge(length, d.config.MaxMessageBytes)
+	}
+
+	if d.curBatchSize+length > d.config.MaxMessageBytes ||
+		d.curRowCount >= d.config.MaxBatchSize {
+		d.flush()
+	}
+
+	d.appendToBuf(key, valueFrame, callback)
+	d.curBatchSize += length
+	d.curRowCount++
+	d.observeMessageResult("handle_key_only")
+	return nil
+}
+
+// observeEncodeDuration records how long the calling encode method took,
+// when metrics are enabled via config.MetricsRegisterer.
+func (d *BatchEncoder) observeEncodeDuration(start time.Time) {
+	if d.config.MetricsRegisterer == nil {
+		return
+	}
+	encodeDurationHistogram.Observe(time.Since(start).Seconds())
+}
+
+// observeEncodeBytes records the pre-compression size of an encoded value
+// and, if it was compressed, the resulting compression ratio.
+func (d *BatchEncoder) observeEncodeBytes(originalLen int, compressed bool, compressedLen int) {
+	if d.config.MetricsRegisterer == nil {
+		return
+	}
+	encodeBytesHistogram.Observe(float64(originalLen))
+	if compressed && originalLen > 0 {
+		compressionRatioHistogram.Observe(float64(compressedLen) / float64(originalLen))
+	}
+}
+
+// observeMessageResult increments the per-result message counter, when
+// metrics are enabled via config.MetricsRegisterer.
+func (d *BatchEncoder) observeMessageResult(result string) {
+	if d.config.MetricsRegisterer == nil {
+		return
+	}
+	messagesTotalCounter.WithLabelValues(result).Inc()
+}
+
+// maybeCompress applies the configured compression codec to value, but only
+// when value is at least CompressionMinSize bytes: small keys/values gain
+// nothing from Snappy/LZ4 beyond wasted CPU and framing overhead, so they are
+// left untouched and the per-frame flag records that decision for the decoder.
+func (d *BatchEncoder) maybeCompress(value []byte) ([]byte, bool, error) {
+	codecName := d.config.LargeMessageHandle.LargeMessageHandleCompression
+	if codecName == "" || codecName == compression.None {
+		return value, false, nil
+	}
+	if len(value) < d.config.CompressionMinSize {
+		return value, false, nil
+	}
+
+	compressed, err := compression.Encode(codecName, value)
+	if err != nil {
+		return nil, false, cerrorWrap(err)
+	}
+	return compressed, true, nil
+}
+
+// appendToBuf buffers a not-yet-flushed key/value pair into the in-progress batch.
+func (d *BatchEncoder) appendToBuf(key, valueFrame []byte, callback func()) {
+	if d.curRowCount == 0 {
+		m := common.NewMsg(versionHead, nil)
+		d.messageBuf = append(d.messageBuf, m)
+	}
+
+	cur := d.messageBuf[len(d.messageBuf)-1]
+	cur.Key = append(cur.Key, encodeLengthFrame(key)...)
+	cur.Value = append(cur.Value, valueFrame...)
+	if callback != nil {
+		d.callbackBuf = append(d.callbackBuf, callback)
+	}
+}
+
+// flush closes out the current in-progress message and wires up its
+// callbacks, starting a fresh one for subsequent events.
+func (d *BatchEncoder) flush() {
+	if d.curRowCount == 0 {
+		return
+	}
+	callbacks := d.callbackBuf
+	cur := d.messageBuf[len(d.messageBuf)-1]
+	cur.Callback = func() {
+		for _, cb := range callbacks {
+			cb()
+		}
+	}
+
+	if d.config.MetricsRegisterer != nil {
+		batchRowCountHistogram.Observe(float64(d.curRowCount))
+	}
+	d.observeMessageResult("ok")
+
+	d.callbackBuf = nil
+	d.curBatchSize = 0
+	d.curRowCount = 0
+}
+
+// Build implements the RowEventEncoder interface
+func (d *BatchEncoder) Build() []*common.Message {
+	d.flush()
+	ret := d.messageBuf
+	d.messageBuf = nil
+	return ret
+}
+
+// encodeKey behaves like marshalJSON and shares its pool: a key and a value
+// borrow distinct buffers from marshalBufPool, so both can be alive at once
+// within a single encode call.
+func encodeKey(keyMsg *messageKey) (encoded []byte, release func(), err error) {
+	return marshalJSON(keyMsg)
+}
+
+// encodeValueFrame writes a length-prefixed, flag-tagged value frame:
+// [uint64 length][1 byte flag][payload]. The flag records whether payload is
+// compressed so that BatchDecoder can skip decompression for small messages
+// that were never compressed in the first place.
+func encodeValueFrame(payload []byte, compressed bool) []byte {
+	var flag byte
+	if compressed {
+		flag = valueFlagCompressed
+	}
+	buf := make([]byte, 8+1+len(payload))
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(payload)+1))
+	buf[8] = flag
+	copy(buf[9:], payload)
+	return buf
+}
+
+func encodeLengthFrame(payload []byte) []byte {
+	buf := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(payload)))
+	copy(buf[8:], payload)
+	return buf
+}
+
+// batchEncoderBuilder builds a `BatchEncoder`
+type batchEncoderBuilder struct {
+	config *common.Config
+}
+
+// Build a `BatchEncoder`
+func (b *batchEncoderBuilder) Build() codec.RowEventEncoder {
+	if b.config.MetricsRegisterer != nil {
+		InitMetrics(b.config.MetricsRegisterer)
+	}
+	return &BatchEncoder{config: b.config}
+}
+
+// CleanMetrics implements the RowEventEncoderBuilder interface
+func (b *batchEncoderBuilder) CleanMetrics() {}
+
+// NewBatchEncoderBuilder creates an open-protocol batchEncoderBuilder.
+func NewBatchEncoderBuilder(ctx context.Context, config *common.Config) (codec.RowEventEncoderBuilder, error) {
+	return &batchEncoderBuilder{config: config}, nil
+}
@@ -422,3 +422,56 @@ func TestE2EClaimCheckMessage(t *testing.T) {
 		require.Equal(t, column.Value, decodedColumn.Value, colName)
 	}
 }
+
+// TestE2ESizeThresholdCompression mixes a tiny DDL event and a checkpoint
+// event, neither of which meets `CompressionMinSize`, with a larger DDL event
+// that does, and verifies the encoder only compresses the messages that
+// cross the threshold while the decoder transparently handles both.
+func TestE2ESizeThresholdCompression(t *testing.T) {
+	helper := entry.NewSchemaTestHelper(t)
+	defer helper.Close()
+
+	smallDDL := helper.DDL2Event(`create table test.s(a int primary key)`)
+	largeDDL := helper.DDL2Event(
+		`create table test.person(id int, name varchar(32), tiny tinyint unsigned, comment text, primary key(id))`)
+
+	ctx := context.Background()
+
+	codecConfig := common.NewConfig(config.ProtocolOpen)
+	codecConfig.LargeMessageHandle.LargeMessageHandleCompression = compression.Snappy
+	codecConfig.CompressionMinSize = 64
+
+	builder, err := NewBatchEncoderBuilder(ctx, codecConfig)
+	require.NoError(t, err)
+	encoder := builder.Build()
+
+	smallMessage, err := encoder.EncodeDDLEvent(smallDDL)
+	require.NoError(t, err)
+
+	largeMessage, err := encoder.EncodeDDLEvent(largeDDL)
+	require.NoError(t, err)
+
+	waterMark := uint64(1)
+	checkpointMessage, err := encoder.EncodeCheckpointEvent(waterMark)
+	require.NoError(t, err)
+
+	// The compressed flag sits right after the value frame's 8-byte length
+	// prefix. Asserting on it directly is what actually exercises
+	// CompressionMinSize: HasNext below would pass identically even if the
+	// threshold were ignored entirely, since each frame's flag and payload
+	// are always self-consistent.
+	require.Equal(t, byte(0), smallMessage.Value[8], "a value below CompressionMinSize must not be compressed")
+	require.Equal(t, byte(1), largeMessage.Value[8], "a value at or above CompressionMinSize must be compressed")
+
+	decoder, err := NewBatchDecoder(ctx, codecConfig, nil)
+	require.NoError(t, err)
+
+	for _, msg := range []*common.Message{smallMessage, checkpointMessage, largeMessage} {
+		err = decoder.AddKeyValue(msg.Key, msg.Value)
+		require.NoError(t, err)
+
+		_, hasNext, err := decoder.HasNext()
+		require.NoError(t, err)
+		require.True(t, hasNext)
+	}
+}
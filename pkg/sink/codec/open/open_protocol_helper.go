@@ -0,0 +1,182 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"fmt"
+	"sort"
+
+	timodel "github.com/pingcap/tidb/pkg/parser/model"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/parser/types"
+	"github.com/pingcap/tiflow/cdc/model"
+	cerror "github.com/pingcap/tiflow/pkg/errors"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+)
+
+// rowChangeToMsg converts a row changed event into its open protocol key/value pair.
+func rowChangeToMsg(e *model.RowChangedEvent) (*messageKey, *messageRow) {
+	var partition *int64
+	if e.TableInfo.IsPartitionTable() {
+		p := e.PhysicalTableID
+		partition = &p
+	}
+
+	key := &messageKey{
+		Ts:        e.CommitTs,
+		Schema:    e.TableInfo.TableName.Schema,
+		Table:     e.TableInfo.TableName.Table,
+		Partition: partition,
+		Type:      model.MessageTypeRow,
+	}
+
+	value := &messageRow{}
+	switch {
+	case e.IsDelete():
+		value.Delete = columnsToMap(e.PreColumns, e.TableInfo)
+	case e.IsUpdate():
+		value.Update = columnsToMap(e.Columns, e.TableInfo)
+		value.PreColumns = columnsToMap(e.PreColumns, e.TableInfo)
+	default:
+		value.Update = columnsToMap(e.Columns, e.TableInfo)
+	}
+	return key, value
+}
+
+func columnsToMap(columns []*model.ColumnData, tableInfo *model.TableInfo) map[string]column {
+	if len(columns) == 0 {
+		return nil
+	}
+	result := make(map[string]column, len(columns))
+	for _, col := range columns {
+		if col == nil {
+			continue
+		}
+		name := tableInfo.ForceGetColumnName(col.ColumnID)
+		result[name] = column{
+			Type:  byte(tableInfo.ForceGetColumnFlagType(col.ColumnID)),
+			Value: col.Value,
+		}
+	}
+	return result
+}
+
+// handleKeyColumnsToMap behaves like columnsToMap but keeps only the
+// handle-key columns, for LargeMessageHandleOptionHandleKeyOnly: a consumer
+// that only needs to identify the changed row (e.g. to trigger a downstream
+// refetch) doesn't need the full, possibly oversized, column set that
+// tripped the length check in the first place.
+func handleKeyColumnsToMap(columns []*model.ColumnData, tableInfo *model.TableInfo) map[string]column {
+	if len(columns) == 0 {
+		return nil
+	}
+	result := make(map[string]column)
+	for _, col := range columns {
+		if col == nil || !tableInfo.ForceGetColumnFlagType(col.ColumnID).IsHandleKey() {
+			continue
+		}
+		name := tableInfo.ForceGetColumnName(col.ColumnID)
+		result[name] = column{
+			Type:  byte(tableInfo.ForceGetColumnFlagType(col.ColumnID)),
+			Value: col.Value,
+		}
+	}
+	return result
+}
+
+// buildDecodedTableInfo reconstructs just enough of a model.TableInfo to
+// satisfy TableInfo.ForceGetColumnName/ForceGetColumnFlagType for a decoded
+// row: the wire format only ever carries column names and flags, never a
+// full TiDB schema. maps is the row's Update/PreColumns/Delete column maps;
+// every name across all of them gets a single, stable ID so a column that
+// appears in more than one (an update's new and old value) resolves to the
+// same ColumnData.ColumnID in both.
+func buildDecodedTableInfo(schema, table string, maps ...map[string]column) (*model.TableInfo, map[string]int64) {
+	flagOf := make(map[string]byte)
+	for _, m := range maps {
+		for name, col := range m {
+			if _, ok := flagOf[name]; !ok {
+				flagOf[name] = col.Type
+			}
+		}
+	}
+
+	names := make([]string, 0, len(flagOf))
+	for name := range flagOf {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ids := make(map[string]int64, len(names))
+	colInfos := make([]*timodel.ColumnInfo, 0, len(names))
+	for i, name := range names {
+		id := int64(i + 1)
+		ids[name] = id
+
+		ft := types.NewFieldType(mysql.TypeVarchar)
+		ft.SetFlag(uint(flagOf[name]))
+		colInfos = append(colInfos, &timodel.ColumnInfo{
+			ID:        id,
+			Name:      timodel.NewCIStr(name),
+			FieldType: *ft,
+		})
+	}
+	return model.BuildTableInfo(schema, table, colInfos, nil), ids
+}
+
+// msgToColumnData converts one wire column map (Update, PreColumns, or
+// Delete) into model.ColumnData, looking up each column's ID from ids, which
+// buildDecodedTableInfo built over the row's full set of column names.
+func msgToColumnData(cols map[string]column, ids map[string]int64) []*model.ColumnData {
+	if len(cols) == 0 {
+		return nil
+	}
+	data := make([]*model.ColumnData, 0, len(cols))
+	for name, col := range cols {
+		data = append(data, &model.ColumnData{
+			ColumnID: ids[name],
+			Value:    col.Value,
+		})
+	}
+	return data
+}
+
+func newResolvedMessage(key, valueFrame []byte, ts uint64) *common.Message {
+	m := common.NewMsg(encodeLengthFrame(key), valueFrame)
+	m.Ts = ts
+	m.Type = int(model.MessageTypeResolved)
+	return prependVersion(m)
+}
+
+func newDDLMessage(key, valueFrame []byte, ts uint64) *common.Message {
+	m := common.NewMsg(encodeLengthFrame(key), valueFrame)
+	m.Ts = ts
+	m.Type = int(model.MessageTypeDDL)
+	return prependVersion(m)
+}
+
+// prependVersion prefixes the key byte stream with the open protocol version
+// header, matching the batch format written by AppendRowChangedEvent.
+func prependVersion(m *common.Message) *common.Message {
+	m.Key = append(append([]byte{}, versionHead...), m.Key...)
+	return m
+}
+
+func errMessageTooLarge(length, limit int) error {
+	return cerror.ErrMessageTooLarge.GenWithStackByArgs(fmt.Sprintf("%d exceeds max-message-bytes %d", length, limit))
+}
+
+func cerrorWrap(err error) error {
+	return cerror.WrapError(cerror.ErrEncodeFailed, err)
+}
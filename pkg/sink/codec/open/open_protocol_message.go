@@ -0,0 +1,80 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package open
+
+import (
+	"github.com/pingcap/tiflow/cdc/model"
+)
+
+// messageKey is the JSON envelope stored in a Kafka message's key. It carries
+// just enough information for the decoder to route the paired value to the
+// right event without having to parse the value first.
+type messageKey struct {
+	Ts        uint64            `json:"ts"`
+	Schema    string            `json:"scm,omitempty"`
+	Table     string            `json:"tbl,omitempty"`
+	RowID     int64             `json:"rid,omitempty"`
+	Partition *int64            `json:"ptn,omitempty"`
+	Type      model.MessageType `json:"t"`
+
+	// OnlyHandleKey is true when the encoder only emitted the event's handle key
+	// columns, see `LargeMessageHandleOptionHandleKeyOnly`.
+	OnlyHandleKey bool `json:"ohk,omitempty"`
+	// ClaimCheckLocation is set when the event was too large to fit and was
+	// instead persisted to external storage, see `LargeMessageHandleOptionClaimCheck`.
+	ClaimCheckLocation string `json:"ccl,omitempty"`
+
+	// Chunked marks a message whose value is a `chunkFragment` rather than a
+	// `messageRow`, see `LargeMessageHandleOptionChunked`.
+	Chunked bool `json:"cnk,omitempty"`
+}
+
+// column is the wire representation of a single column's value, used inside
+// a messageRow's Update/Delete/PreColumns maps.
+type column struct {
+	Type  byte        `json:"t"`
+	Flag  uint64      `json:"f,omitempty"`
+	Value interface{} `json:"v"`
+}
+
+// messageRow is the JSON envelope stored in a Kafka message's value for a row
+// change event, before any compression is applied.
+type messageRow struct {
+	Update     map[string]column `json:"u,omitempty"`
+	PreColumns map[string]column `json:"p,omitempty"`
+	Delete     map[string]column `json:"d,omitempty"`
+}
+
+// messageDDL is the JSON envelope stored in a Kafka message's value for a DDL event.
+type messageDDL struct {
+	Query string `json:"q"`
+	Type  byte   `json:"t"`
+}
+
+// chunkFragment is the value envelope for one fragment of a row that was
+// split under `LargeMessageHandleOptionChunked` because its encoded form did
+// not fit within `MaxMessageBytes`. Every fragment for the same row shares
+// MessageID and Total and carries the same messageKey, so Kafka routes them
+// to the same partition; Seq orders them for reassembly. Unlike the other
+// envelopes in this file, a chunkFragment is never JSON-marshaled - Payload
+// is raw bytes, and encoding/json would base64-encode it - see
+// encodeChunkFragment/decodeChunkFragmentBytes for its actual wire format.
+type chunkFragment struct {
+	MessageID      string
+	Seq            int
+	Total          int
+	OriginalLength int
+	Checksum       uint32
+	Payload        []byte
+}